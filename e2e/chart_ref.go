@@ -0,0 +1,116 @@
+// Copyright 2017 Mirantis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package e2e
+
+import "fmt"
+
+// ChartRef identifies a chart to install or upgrade to. Exactly one of Path,
+// Repo/Chart or OCI should be set.
+type ChartRef struct {
+	// Path is a local chart directory or packaged .tgz, passed to helm as-is.
+	Path string
+	// Repo and Chart identify a chart hosted in a previously added repo,
+	// e.g. Repo: "stable", Chart: "mysql".
+	Repo  string
+	Chart string
+	// Version pins Repo/Chart to a specific chart version constraint.
+	// Ignored for Path and OCI references.
+	Version string
+	// OCI is a fully qualified oci://registry/repository/chart reference.
+	OCI string
+}
+
+// LocalChart builds a ChartRef pointing at a local chart path.
+func LocalChart(path string) ChartRef {
+	return ChartRef{Path: path}
+}
+
+// RepoChart builds a ChartRef pointing at a chart in a previously added
+// repository, optionally pinned to version.
+func RepoChart(repo, chart, version string) ChartRef {
+	return ChartRef{Repo: repo, Chart: chart, Version: version}
+}
+
+// OCIChart builds a ChartRef pointing at an OCI registry reference.
+func OCIChart(ref string) ChartRef {
+	return ChartRef{OCI: ref}
+}
+
+// String renders the ChartRef the way the helm binary expects it on the
+// command line.
+func (c ChartRef) String() string {
+	switch {
+	case c.OCI != "":
+		return c.OCI
+	case c.Repo != "" && c.Chart != "":
+		return fmt.Sprintf("%s/%s", c.Repo, c.Chart)
+	default:
+		return c.Path
+	}
+}
+
+// versionArgs returns the extra helm CLI args needed to pin a Repo/Chart
+// reference to Version, if any.
+func (c ChartRef) versionArgs() []string {
+	if c.Repo != "" && c.Chart != "" && c.Version != "" {
+		return []string{"--version", c.Version}
+	}
+	return nil
+}
+
+// RepoCredentials carries the authentication needed to add a private chart
+// repository or OCI registry.
+type RepoCredentials struct {
+	// Username/Password are used for basic auth.
+	Username string
+	Password string
+	// BearerToken is not supported: args, and so AddRepo, returns an error
+	// when it is set.
+	BearerToken string
+	// CertFile/KeyFile/CAFile configure TLS client cert auth.
+	CertFile string
+	KeyFile  string
+	CAFile   string
+}
+
+// args renders the credentials as the flags accepted by `helm repo add`. It
+// errors if BearerToken is set: `helm repo add` has no bearer-token flag, so
+// silently dropping it would add the repo unauthenticated instead of
+// failing the way a misconfigured credential should.
+func (c *RepoCredentials) args() ([]string, error) {
+	if c == nil {
+		return nil, nil
+	}
+	if c.BearerToken != "" {
+		return nil, fmt.Errorf("RepoCredentials.BearerToken is not supported by `helm repo add`; use Username/Password or a client cert instead")
+	}
+	var arg []string
+	if c.Username != "" {
+		arg = append(arg, "--username", c.Username)
+	}
+	if c.Password != "" {
+		arg = append(arg, "--password", c.Password)
+	}
+	if c.CertFile != "" {
+		arg = append(arg, "--cert-file", c.CertFile)
+	}
+	if c.KeyFile != "" {
+		arg = append(arg, "--key-file", c.KeyFile)
+	}
+	if c.CAFile != "" {
+		arg = append(arg, "--ca-file", c.CAFile)
+	}
+	return arg, nil
+}
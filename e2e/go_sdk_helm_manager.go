@@ -0,0 +1,311 @@
+// Copyright 2017 Mirantis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package e2e
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/rest"
+
+	"k8s.io/helm/pkg/helm"
+	"k8s.io/helm/pkg/proto/hapi/release"
+
+	"github.com/Mirantis/rudder-appcontroller/pkg/appcontrollerutil"
+	"github.com/Mirantis/rudder-appcontroller/pkg/helm/portforwarder"
+	"github.com/nebril/helm/pkg/kube"
+
+	. "github.com/onsi/ginkgo"
+)
+
+// chartCacheDir is where GoSDKHelmManager untars fetched repo/OCI charts, so
+// that repeated installs of the same unpinned chart don't refetch it; a chart
+// pinned to a Version is fetched again on every install.
+const chartCacheDir = "/tmp/rudder-e2e-chart-cache"
+
+// GoSDKHelmManager talks to tiller/rudder directly through the helm Go
+// client instead of shelling out to the helm binary. It avoids scraping
+// human-readable CLI output by working with the typed *release.Release
+// objects returned by the SDK.
+type GoSDKHelmManager struct {
+	Clientset  kubernetes.Interface
+	RESTConfig *rest.Config
+	Namespace  string
+	KubeClient *kube.Client
+	Timeouts   Timeouts
+
+	forwarder *portforwarder.Forwarder
+	client    *helm.Client
+}
+
+func (m *GoSDKHelmManager) InstallTiller() error {
+	arg := []string{"init", "--tiller-namespace", m.Namespace}
+	if enableRudder {
+		arg = append(arg, "--tiller-image", experimentalTillerImage)
+	}
+	// Bootstrapping tiller itself still goes through the CLI: the Go SDK
+	// has nothing that replaces `helm init`.
+	if _, err := runHelmBin(arg...); err != nil {
+		return err
+	}
+	By("Waiting for tiller pod")
+	timeouts := m.Timeouts.orDefaults()
+	pod := waitTillerPod(m.Clientset, m.Namespace, timeouts.TillerReady, timeouts.PodPoll)
+	if enableRudder {
+		By("Adding rudder")
+		addRudderToTillerPod(m.Clientset, m.Namespace)
+		if pod != nil {
+			By("Removing original rudder pod " + pod.Name)
+			zero := int64(0)
+			if err := m.Clientset.Core().Pods(m.Namespace).Delete(pod.Name, &v1.DeleteOptions{GracePeriodSeconds: &zero}); err != nil {
+				return err
+			}
+		}
+		waitTillerPod(m.Clientset, m.Namespace, timeouts.TillerReady, timeouts.PodPoll)
+		By("Adding appcontroller")
+		addAppcontroller(m.Clientset, m.Namespace)
+	}
+	return m.connect()
+}
+
+func (m *GoSDKHelmManager) DeleteTiller(removeHelmHome bool) error {
+	if m.forwarder != nil {
+		m.forwarder.Close()
+		m.forwarder = nil
+	}
+	arg := []string{"reset", "--tiller-namespace", m.Namespace, "--force"}
+	if removeHelmHome {
+		arg = append(arg, "--remove-helm-home")
+	}
+	_, err := runHelmBin(arg...)
+	return err
+}
+
+// Install installs chart and returns the parsed release.
+func (m *GoSDKHelmManager) Install(chart ChartRef, values map[string]string) (*release.Release, error) {
+	return m.install(chart, values)
+}
+
+// Status returns the parsed release, and a non-nil error if it's not DEPLOYED.
+func (m *GoSDKHelmManager) Status(releaseName string) (*release.Release, error) {
+	client, err := m.helmClient()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.ReleaseStatus(releaseName)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't fetch status for release %v: %v", releaseName, err)
+	}
+	rel := &release.Release{Name: resp.Name, Namespace: resp.Namespace, Info: resp.Info}
+	if resp.Info.Status.Code != release.Status_DEPLOYED {
+		return rel, fmt.Errorf("Expected status is DEPLOYED. But got %v for release %v.", resp.Info.Status.Code, releaseName)
+	}
+	return rel, nil
+}
+
+func (m *GoSDKHelmManager) Delete(releaseName string) error {
+	client, err := m.helmClient()
+	if err != nil {
+		return err
+	}
+	timeouts := m.Timeouts.orDefaults()
+	_, err = client.DeleteRelease(releaseName, helm.DeleteTimeout(timeoutSecondsInt64(timeouts.Delete)))
+	return err
+}
+
+func (m *GoSDKHelmManager) Upgrade(chart ChartRef, releaseName string, values map[string]string) (*release.Release, error) {
+	client, err := m.helmClient()
+	if err != nil {
+		return nil, err
+	}
+	chartPath, err := m.resolveChart(chart)
+	if err != nil {
+		return nil, err
+	}
+	overrides, err := valuesToYAML(values)
+	if err != nil {
+		return nil, err
+	}
+	timeouts := m.Timeouts.orDefaults()
+	resp, err := client.UpdateRelease(releaseName, chartPath,
+		helm.UpdateValueOverrides(overrides), helm.UpgradeTimeout(timeoutSecondsInt64(timeouts.Upgrade)))
+	if err != nil {
+		return nil, err
+	}
+	m.relabelReleaseResources(releaseName, resp.Release)
+	return resp.Release, nil
+}
+
+func (m *GoSDKHelmManager) Rollback(releaseName string, revision int) (*release.Release, error) {
+	client, err := m.helmClient()
+	if err != nil {
+		return nil, err
+	}
+	timeouts := m.Timeouts.orDefaults()
+	resp, err := client.RollbackRelease(releaseName,
+		helm.RollbackVersion(int32(revision)), helm.RollbackTimeout(timeoutSecondsInt64(timeouts.Rollback)))
+	if err != nil {
+		return nil, err
+	}
+	return resp.Release, nil
+}
+
+// Wait polls the AppController dependency graph for releaseName until every
+// scheduled resource is unblocked and Ready.
+func (m *GoSDKHelmManager) Wait(releaseName string, timeout time.Duration) error {
+	return appcontrollerutil.WaitForRelease(m.KubeClient, m.Namespace, releaseName, timeout)
+}
+
+func (m *GoSDKHelmManager) install(chart ChartRef, values map[string]string) (*release.Release, error) {
+	client, err := m.helmClient()
+	if err != nil {
+		return nil, err
+	}
+	chartPath, err := m.resolveChart(chart)
+	if err != nil {
+		return nil, err
+	}
+	overrides, err := valuesToYAML(values)
+	if err != nil {
+		return nil, err
+	}
+	timeouts := m.Timeouts.orDefaults()
+	resp, err := client.InstallRelease(chartPath, m.Namespace,
+		helm.ValueOverrides(overrides), helm.InstallTimeout(timeoutSecondsInt64(timeouts.Install)))
+	if err != nil {
+		return nil, err
+	}
+	if resp.Release != nil {
+		m.relabelReleaseResources(resp.Release.Name, resp.Release)
+	}
+	return resp.Release, nil
+}
+
+// timeoutSecondsInt64 converts a time.Duration into the integer-seconds
+// value the helm Go SDK's per-call timeout options still expect.
+func timeoutSecondsInt64(d time.Duration) int64 {
+	return int64(d / time.Second)
+}
+
+// relabelReleaseResources is a best-effort call to stamp helmRelease onto
+// rel's resources, used right after both Install and Upgrade since nothing
+// stamps the label at resource-creation time; a failure here only means the
+// release selector stays incomplete, so it's logged rather than returned.
+func (m *GoSDKHelmManager) relabelReleaseResources(releaseName string, rel *release.Release) {
+	if rel == nil {
+		return
+	}
+	if err := appcontrollerutil.RelabelResourceDefinitions(m.KubeClient, m.Namespace, releaseName, int(rel.Version), rel.Manifest); err != nil {
+		log.Printf("WARNING: couldn't relabel resources for release %v: %v", releaseName, err)
+	}
+}
+
+// resolveChart returns a local chart path for chart, fetching and caching it
+// first if it's a repo/chart or OCI reference. The Go SDK client only knows
+// how to install from a local path, so repo/registry resolution still goes
+// through the helm binary, same as tiller bootstrap.
+func (m *GoSDKHelmManager) resolveChart(chart ChartRef) (string, error) {
+	if chart.Path != "" {
+		return chart.Path, nil
+	}
+
+	name := chart.Chart
+	if name == "" {
+		name = filepath.Base(chart.OCI)
+	}
+	cached := filepath.Join(chartCacheDir, name)
+	if chart.Version == "" {
+		// Unpinned references are still worth reusing within a single test
+		// run; a pinned version is fetched fresh since it identifies a
+		// different chart each time it changes.
+		if _, err := os.Stat(cached); err == nil {
+			return cached, nil
+		}
+	}
+
+	arg := append([]string{"fetch", chart.String(), "--untar", "--untardir", chartCacheDir}, chart.versionArgs()...)
+	if _, err := runHelmBin(arg...); err != nil {
+		return "", fmt.Errorf("couldn't fetch chart %v: %v", chart.String(), err)
+	}
+	return cached, nil
+}
+
+// AddRepo registers a chart repository or OCI registry with the local helm
+// home used by the fetches resolveChart performs.
+func (m *GoSDKHelmManager) AddRepo(name, url string, creds *RepoCredentials) error {
+	credArgs, err := creds.args()
+	if err != nil {
+		return err
+	}
+	arg := append([]string{"repo", "add", name, url}, credArgs...)
+	_, err = runHelmBin(arg...)
+	return err
+}
+
+// UpdateRepos refreshes the local index of every added repository.
+func (m *GoSDKHelmManager) UpdateRepos() error {
+	_, err := runHelmBin("repo", "update")
+	return err
+}
+
+// helmClient lazily establishes a port-forwarded connection to tiller and
+// returns a client bound to it, reusing the forward across calls.
+func (m *GoSDKHelmManager) helmClient() (*helm.Client, error) {
+	if m.client != nil {
+		return m.client, nil
+	}
+	if err := m.connect(); err != nil {
+		return nil, err
+	}
+	return m.client, nil
+}
+
+func (m *GoSDKHelmManager) connect() error {
+	fwd, err := portforwarder.New(m.RESTConfig, m.Clientset, m.Namespace)
+	if err != nil {
+		return fmt.Errorf("couldn't open port forward to tiller: %v", err)
+	}
+	m.forwarder = fwd
+	m.client = helm.NewClient(helm.Host(fwd.Addr()))
+	return nil
+}
+
+func valuesToYAML(values map[string]string) (string, error) {
+	var b []byte
+	for key, val := range values {
+		b = append(b, []byte(fmt.Sprintf("%s: %s\n", key, val))...)
+	}
+	return string(b), nil
+}
+
+// runHelmBin shells out to the helm CLI for the handful of operations (tiller
+// bootstrap/teardown, chart fetch, repo add/update) the Go SDK doesn't cover.
+func runHelmBin(arg ...string) (string, error) {
+	cmd := exec.Command("helm", arg...)
+	Logf("Running command %+v\n", cmd.Args)
+	stdout, err := cmd.Output()
+	if err != nil {
+		stderr := err.(*exec.ExitError)
+		Logf("Command %+v, Err %s\n", cmd.Args, stderr.Stderr)
+		return "", err
+	}
+	return string(stdout), nil
+}
@@ -16,7 +16,9 @@ package e2e
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
+	"log"
 	"os/exec"
 	"regexp"
 	"strconv"
@@ -26,6 +28,11 @@ import (
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/pkg/api/v1"
 
+	"k8s.io/helm/pkg/proto/hapi/release"
+
+	"github.com/Mirantis/rudder-appcontroller/pkg/appcontrollerutil"
+	"github.com/nebril/helm/pkg/kube"
+
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
@@ -44,23 +51,91 @@ type HelmManager interface {
 	InstallTiller() error
 	// DeleteTiller removes tiller pod from k8s
 	DeleteTiller(removeHelmHome bool) error
-	// Install chart, returns releaseName and error
-	Install(chartName string, values map[string]string) (string, error)
-	// Status verifies state of installed release
-	Status(releaseName string) error
+	// Install chart, returns the parsed release and error
+	Install(chart ChartRef, values map[string]string) (*release.Release, error)
+	// Status verifies state of installed release and returns the parsed release
+	Status(releaseName string) (*release.Release, error)
 	// Delete release
 	Delete(releaseName string) error
-	// Upgrade release
-	Upgrade(chartName, releaseName string, values map[string]string) error
-	// Rollback release
-	Rollback(releaseName string, revision int) error
+	// Upgrade release, returns the parsed release and error
+	Upgrade(chart ChartRef, releaseName string, values map[string]string) (*release.Release, error)
+	// Rollback release, returns the parsed release and error
+	Rollback(releaseName string, revision int) (*release.Release, error)
+	// Wait blocks until every resource scheduled for releaseName is ready,
+	// or returns an error once timeout elapses
+	Wait(releaseName string, timeout time.Duration) error
+	// AddRepo registers a chart repository or OCI registry under name,
+	// authenticating with creds if it's non-nil
+	AddRepo(name, url string, creds *RepoCredentials) error
+	// UpdateRepos refreshes the local index of every added repository
+	UpdateRepos() error
+}
+
+// Timeouts configures how long BinaryHelmManager waits for helm subprocesses
+// and tiller to become ready before giving up. A zero Timeouts behaves like
+// DefaultTimeouts.
+type Timeouts struct {
+	TillerReady time.Duration
+	Install     time.Duration
+	Upgrade     time.Duration
+	Rollback    time.Duration
+	Delete      time.Duration
+	PodPoll     time.Duration
+}
+
+// DefaultTimeouts reproduces the waits this package used before timeouts
+// became configurable: the tiller pod waits waitTillerPod hardcoded, and the
+// helm binary's own 300-second --timeout default for release operations.
+func DefaultTimeouts() Timeouts {
+	return Timeouts{
+		TillerReady: 2 * time.Minute,
+		Install:     5 * time.Minute,
+		Upgrade:     5 * time.Minute,
+		Rollback:    5 * time.Minute,
+		Delete:      5 * time.Minute,
+		PodPoll:     5 * time.Second,
+	}
+}
+
+func (t Timeouts) orDefaults() Timeouts {
+	d := DefaultTimeouts()
+	if t.TillerReady == 0 {
+		t.TillerReady = d.TillerReady
+	}
+	if t.Install == 0 {
+		t.Install = d.Install
+	}
+	if t.Upgrade == 0 {
+		t.Upgrade = d.Upgrade
+	}
+	if t.Rollback == 0 {
+		t.Rollback = d.Rollback
+	}
+	if t.Delete == 0 {
+		t.Delete = d.Delete
+	}
+	if t.PodPoll == 0 {
+		t.PodPoll = d.PodPoll
+	}
+	return t
 }
 
 // BinaryHelmManager uses helm binary to work with helm server
 type BinaryHelmManager struct {
-	Clientset kubernetes.Interface
-	Namespace string
-	HelmBin   string
+	Clientset  kubernetes.Interface
+	Namespace  string
+	HelmBin    string
+	KubeClient *kube.Client
+	Timeouts   Timeouts
+
+	// addedRepos tracks repositories already registered with the local helm
+	// home in this process, so repeated AddRepo calls (and the install of
+	// every fixture using the same repo) don't re-hit the network.
+	addedRepos map[string]bool
+
+	// supportsJSONOutput caches the result of probing HelmBin for --output
+	// support, so every call doesn't re-exec `helm version`.
+	supportsJSONOutput *bool
 }
 
 func (m *BinaryHelmManager) InstallTiller() error {
@@ -74,7 +149,8 @@ func (m *BinaryHelmManager) InstallTiller() error {
 		return err
 	}
 	By("Waiting for tiller pod")
-	pod := waitTillerPod(m.Clientset, m.Namespace)
+	timeouts := m.Timeouts.orDefaults()
+	pod := waitTillerPod(m.Clientset, m.Namespace, timeouts.TillerReady, timeouts.PodPoll)
 	if enableRudder {
 		By("Adding rudder")
 		addRudderToTillerPod(m.Clientset, m.Namespace)
@@ -86,7 +162,7 @@ func (m *BinaryHelmManager) InstallTiller() error {
 			})
 			Expect(err).NotTo(HaveOccurred())
 		}
-		waitTillerPod(m.Clientset, m.Namespace)
+		waitTillerPod(m.Clientset, m.Namespace, timeouts.TillerReady, timeouts.PodPoll)
 		By("Adding appcontroller")
 		addAppcontroller(m.Clientset, m.Namespace)
 	}
@@ -106,49 +182,194 @@ func (m *BinaryHelmManager) DeleteTiller(removeHelmHome bool) error {
 	return nil
 }
 
-func (m *BinaryHelmManager) Install(chartName string, values map[string]string) (string, error) {
-	stdout, err := m.executeCommandWithValues(chartName, "install", values)
+func (m *BinaryHelmManager) Install(chart ChartRef, values map[string]string) (*release.Release, error) {
+	timeouts := m.Timeouts.orDefaults()
+	extraArgs := append([]string{"--timeout", timeoutSeconds(timeouts.Install)}, m.outputJSONArgs()...)
+	extraArgs = append(extraArgs, chart.versionArgs()...)
+	stdout, err := m.executeCommandWithValues(chart.String(), "install", values, extraArgs...)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	return getNameFromHelmOutput(stdout), nil
+	rel, err := decodeRelease(stdout)
+	if err != nil {
+		name := getNameFromHelmOutput(stdout)
+		if name == "" {
+			return nil, err
+		}
+		return &release.Release{Name: name}, nil
+	}
+	m.relabelReleaseResources(rel.Name, rel)
+	return rel, nil
 }
 
-// Status reports nil if release is considered to be succesfull
-func (m *BinaryHelmManager) Status(releaseName string) error {
-	stdout, err := m.executeUsingHelm("status", releaseName, "--tiller-namespace", m.Namespace)
+// Status reports the parsed release, and a non-nil error if the release is
+// not DEPLOYED.
+func (m *BinaryHelmManager) Status(releaseName string) (*release.Release, error) {
+	arg := append([]string{"status", releaseName, "--tiller-namespace", m.Namespace}, m.outputJSONArgs()...)
+	stdout, err := m.executeUsingHelm(arg...)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	status := getStatusFromHelmOutput(stdout)
-	if status == "DEPLOYED" {
-		return nil
+	rel, err := decodeRelease(stdout)
+	if err != nil {
+		status := getStatusFromHelmOutput(stdout)
+		if status != "DEPLOYED" {
+			return nil, fmt.Errorf("Expected status is DEPLOYED. But got %v for release %v.", status, releaseName)
+		}
+		return &release.Release{Name: releaseName}, nil
 	}
-	return fmt.Errorf("Expected status is DEPLOYED. But got %v for release %v.", status, releaseName)
+	if rel.Info.Status.Code != release.Status_DEPLOYED {
+		return rel, fmt.Errorf("Expected status is DEPLOYED. But got %v for release %v.", rel.Info.Status.Code, releaseName)
+	}
+	return rel, nil
 }
 
 func (m *BinaryHelmManager) Delete(releaseName string) error {
-	_, err := m.executeUsingHelm("delete", releaseName, "--tiller-namespace", m.Namespace)
+	timeouts := m.Timeouts.orDefaults()
+	_, err := m.executeUsingHelm("delete", releaseName, "--tiller-namespace", m.Namespace, "--timeout", timeoutSeconds(timeouts.Delete))
 	return err
 }
 
-func (m *BinaryHelmManager) Upgrade(chartName, releaseName string, values map[string]string) error {
-	arg := make([]string, 0, 9)
-	arg = append(arg, "upgrade", releaseName, chartName)
+func (m *BinaryHelmManager) Upgrade(chart ChartRef, releaseName string, values map[string]string) (*release.Release, error) {
+	timeouts := m.Timeouts.orDefaults()
+	arg := make([]string, 0, 13)
+	arg = append(arg, "upgrade", releaseName, chart.String())
 	if len(values) > 0 {
 		arg = append(arg, "--set", prepareArgsFromValues(values))
 	}
-	_, err := m.executeUsingHelmInNamespace(arg...)
-	return err
+	arg = append(arg, "--timeout", timeoutSeconds(timeouts.Upgrade))
+	arg = append(arg, m.outputJSONArgs()...)
+	arg = append(arg, chart.versionArgs()...)
+	stdout, err := m.executeUsingHelmInNamespace(arg...)
+	if err != nil {
+		return nil, err
+	}
+	rel, err := decodeRelease(stdout)
+	if err != nil {
+		name := getNameFromHelmOutput(stdout)
+		if name == "" {
+			return nil, err
+		}
+		return &release.Release{Name: name}, nil
+	}
+	m.relabelReleaseResources(releaseName, rel)
+	return rel, nil
 }
 
-func (m *BinaryHelmManager) Rollback(releaseName string, revision int) error {
-	arg := make([]string, 0, 6)
-	arg = append(arg, "rollback", releaseName, strconv.Itoa(revision), "--tiller-namespace", m.Namespace)
-	_, err := m.executeUsingHelm(arg...)
+func (m *BinaryHelmManager) Rollback(releaseName string, revision int) (*release.Release, error) {
+	timeouts := m.Timeouts.orDefaults()
+	arg := make([]string, 0, 10)
+	arg = append(arg, "rollback", releaseName, strconv.Itoa(revision), "--tiller-namespace", m.Namespace, "--timeout", timeoutSeconds(timeouts.Rollback))
+	arg = append(arg, m.outputJSONArgs()...)
+	stdout, err := m.executeUsingHelm(arg...)
+	if err != nil {
+		return nil, err
+	}
+	rel, err := decodeRelease(stdout)
+	if err != nil {
+		name := getNameFromHelmOutput(stdout)
+		if name == "" {
+			return nil, err
+		}
+		return &release.Release{Name: name}, nil
+	}
+	return rel, nil
+}
+
+// Wait polls the AppController dependency graph for releaseName until every
+// scheduled resource is unblocked and Ready, instead of relying on ad-hoc Eventually
+// loops in the tests themselves.
+func (m *BinaryHelmManager) Wait(releaseName string, timeout time.Duration) error {
+	return appcontrollerutil.WaitForRelease(m.KubeClient, m.Namespace, releaseName, timeout)
+}
+
+// AddRepo registers a chart repository or OCI registry with the local helm
+// home. Repeated calls with the same name are no-ops, so tests and fixtures
+// sharing a repo don't each pay for a fresh index download.
+func (m *BinaryHelmManager) AddRepo(name, url string, creds *RepoCredentials) error {
+	if m.addedRepos == nil {
+		m.addedRepos = map[string]bool{}
+	}
+	if m.addedRepos[name] {
+		return nil
+	}
+	credArgs, err := creds.args()
+	if err != nil {
+		return err
+	}
+	arg := append([]string{"repo", "add", name, url}, credArgs...)
+	if _, err := m.executeUsingHelm(arg...); err != nil {
+		return err
+	}
+	m.addedRepos[name] = true
+	return nil
+}
+
+// UpdateRepos refreshes the cached index of every repository added so far.
+func (m *BinaryHelmManager) UpdateRepos() error {
+	_, err := m.executeUsingHelm("repo", "update")
 	return err
 }
 
+// outputFlagMinMinor is the Helm 2.x minor release that introduced
+// `--output json` on install/status/upgrade/rollback.
+const outputFlagMinMinor = 10
+
+var helmClientVersionRegexp = regexp.MustCompile(`v(\d+)\.(\d+)\.\d+`)
+
+// outputJSONArgs returns the `--output json` flag pair if HelmBin is known to
+// support it, or nil otherwise, so callers can fall back to the legacy
+// regex-scraping path on older helm binaries that would just reject the
+// flag outright.
+func (m *BinaryHelmManager) outputJSONArgs() []string {
+	if !m.jsonOutputSupported() {
+		return nil
+	}
+	return []string{"--output", "json"}
+}
+
+func (m *BinaryHelmManager) jsonOutputSupported() bool {
+	if m.supportsJSONOutput != nil {
+		return *m.supportsJSONOutput
+	}
+	supported := m.detectJSONOutputSupport()
+	m.supportsJSONOutput = &supported
+	return supported
+}
+
+func (m *BinaryHelmManager) detectJSONOutputSupport() bool {
+	stdout, err := m.executeUsingHelm("version", "--client", "--short")
+	if err != nil {
+		return false
+	}
+	match := helmClientVersionRegexp.FindStringSubmatch(stdout)
+	if len(match) < 3 {
+		return false
+	}
+	major, err := strconv.Atoi(match[1])
+	if err != nil {
+		return false
+	}
+	minor, err := strconv.Atoi(match[2])
+	if err != nil {
+		return false
+	}
+	return major > 2 || (major == 2 && minor >= outputFlagMinMinor)
+}
+
+// relabelReleaseResources is a best-effort call to stamp helmRelease onto
+// rel's resources, used right after both Install and Upgrade since nothing
+// stamps the label at resource-creation time; a failure here only means the
+// release selector stays incomplete, so it's logged rather than returned.
+func (m *BinaryHelmManager) relabelReleaseResources(releaseName string, rel *release.Release) {
+	if rel == nil {
+		return
+	}
+	if err := appcontrollerutil.RelabelResourceDefinitions(m.KubeClient, m.Namespace, releaseName, int(rel.Version), rel.Manifest); err != nil {
+		log.Printf("WARNING: couldn't relabel resources for release %v: %v", releaseName, err)
+	}
+}
+
 func (m *BinaryHelmManager) executeUsingHelmInNamespace(arg ...string) (string, error) {
 	arg = append(arg, "--namespace", m.Namespace, "--tiller-namespace", m.Namespace)
 	return m.executeUsingHelm(arg...)
@@ -166,8 +387,8 @@ func (m *BinaryHelmManager) executeUsingHelm(arg ...string) (string, error) {
 	return string(stdout), nil
 }
 
-func (m *BinaryHelmManager) executeCommandWithValues(releaseName, command string, values map[string]string) (string, error) {
-	arg := make([]string, 0, 8)
+func (m *BinaryHelmManager) executeCommandWithValues(releaseName, command string, values map[string]string, extraArgs ...string) (string, error) {
+	arg := make([]string, 0, 8+len(extraArgs))
 	arg = append(arg, command, releaseName)
 	if len(values) > 0 {
 		var b bytes.Buffer
@@ -179,9 +400,32 @@ func (m *BinaryHelmManager) executeCommandWithValues(releaseName, command string
 		}
 		arg = append(arg, "--set", b.String())
 	}
+	arg = append(arg, extraArgs...)
 	return m.executeUsingHelmInNamespace(arg...)
 }
 
+// decodeRelease decodes the output of a `helm --output json` invocation into
+// a typed release, mirroring Helm's own release JSON shape. For helm binaries
+// too old for --output json, outputJSONArgs leaves the flag out and helm
+// prints its usual human-readable text instead, which fails to decode here;
+// callers fall back to the legacy regex scrape in that case.
+func decodeRelease(stdout string) (*release.Release, error) {
+	rel := &release.Release{}
+	if err := json.Unmarshal([]byte(stdout), rel); err != nil {
+		return nil, fmt.Errorf("couldn't decode helm json output: %v", err)
+	}
+	if rel.Name == "" {
+		return nil, fmt.Errorf("decoded release has no name, output is likely not json")
+	}
+	return rel, nil
+}
+
+// timeoutSeconds converts a time.Duration into the integer-seconds string
+// the helm binary's --timeout flag still expects.
+func timeoutSeconds(d time.Duration) string {
+	return strconv.FormatInt(int64(d/time.Second), 10)
+}
+
 func regexpKeyFromStructuredOutput(key, output string) string {
 	r := regexp.MustCompile(fmt.Sprintf("%v:[[:space:]]*(.*)", key))
 	// key will be captured in group with index 1
@@ -200,7 +444,7 @@ func getStatusFromHelmOutput(output string) string {
 	return regexpKeyFromStructuredOutput("STATUS", output)
 }
 
-func waitTillerPod(clientset kubernetes.Interface, namespace string) *v1.Pod {
+func waitTillerPod(clientset kubernetes.Interface, namespace string, timeout, pollInterval time.Duration) *v1.Pod {
 	var tillerPod *v1.Pod
 	Eventually(func() bool {
 		pods, err := clientset.Core().Pods(namespace).List(v1.ListOptions{})
@@ -227,7 +471,7 @@ func waitTillerPod(clientset kubernetes.Interface, namespace string) *v1.Pod {
 			}
 		}
 		return false
-	}, 2*time.Minute, 5*time.Second).Should(BeTrue(), "tiller pod is not running in namespace "+namespace)
+	}, timeout, pollInterval).Should(BeTrue(), "tiller pod is not running in namespace "+namespace)
 	return tillerPod
 }
 
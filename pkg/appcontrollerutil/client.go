@@ -8,7 +8,6 @@ import (
 
 	"google.golang.org/grpc/grpclog"
 
-	"k8s.io/client-go/pkg/labels"
 	"k8s.io/kubernetes/pkg/api"
 	"k8s.io/kubernetes/pkg/kubectl"
 	"k8s.io/kubernetes/pkg/kubectl/resource"
@@ -32,7 +31,12 @@ func (m *missingResource) Key() string {
 	return fmt.Sprintf("%s/%s", strings.ToLower(m.kind), m.name)
 }
 
-func GetStatus(helmClient *kube.Client, namespace string, reader io.Reader) (string, error) {
+// GetStatus renders the status of resources described by reader, scoped to
+// releaseName: any resource missing from the cluster is looked up in the
+// release's own dependency graph (built from resources labeled with
+// appcontrollerutil.ReleaseLabel) rather than the whole namespace, so the
+// MISSING section stays accurate when several releases share a namespace.
+func GetStatus(helmClient *kube.Client, namespace, releaseName string, reader io.Reader) (string, error) {
 	objs := make(map[string][]runtime.Object)
 	infos, err := helmClient.BuildUnstructured(namespace, reader)
 	if err != nil {
@@ -94,10 +98,9 @@ func GetStatus(helmClient *kube.Client, namespace string, reader io.Reader) (str
 		if err != nil {
 			return "", fmt.Errorf("couldn't create namespaced client. Err: %v", err)
 		}
-		// TODO set proper label helmRelease: blabla on resdef creation in rudder
-		selector, err := labels.Parse("")
+		selector, err := ReleaseSelector(releaseName)
 		if err != nil {
-			return "", fmt.Errorf("could't parse release labels. Err: %v", err)
+			return "", err
 		}
 		graph, err := scheduler.BuildDependencyGraph(namespacedClient, selector)
 		if err != nil {
@@ -0,0 +1,138 @@
+package appcontrollerutil
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"k8s.io/client-go/pkg/labels"
+	"k8s.io/kubernetes/pkg/api"
+
+	"github.com/Mirantis/k8s-AppController/pkg/client"
+	"github.com/nebril/helm/pkg/kube"
+)
+
+const (
+	// ReleaseLabel marks a ResourceDefinition or Dependency as belonging to
+	// a helm release, so that a release's own resources can be told apart
+	// from everything else scheduled in the same namespace. The rudder does
+	// not set it when it creates them; RelabelResourceDefinitions stamps it
+	// on a release's existing resources afterwards.
+	ReleaseLabel = "helmRelease"
+	// ReleaseRevisionLabel records the release revision a
+	// ResourceDefinition/Dependency was created for.
+	ReleaseRevisionLabel = "helmReleaseRevision"
+)
+
+// LabelsForRelease returns the labels that mark a ResourceDefinition or
+// Dependency as belonging to revision of releaseName.
+func LabelsForRelease(releaseName string, revision int) map[string]string {
+	return map[string]string{
+		ReleaseLabel:         releaseName,
+		ReleaseRevisionLabel: strconv.Itoa(revision),
+	}
+}
+
+// ReleaseSelector builds a label selector that matches only the
+// ResourceDefinitions/Dependencies that belong to releaseName.
+func ReleaseSelector(releaseName string) (labels.Selector, error) {
+	selector, err := labels.Parse(fmt.Sprintf("%s=%s", ReleaseLabel, releaseName))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't build selector for release %v: %v", releaseName, err)
+	}
+	return selector, nil
+}
+
+// RelabelResourceDefinitions is a best-effort helper that stamps ReleaseLabel
+// on a release's resources that don't carry it yet. manifest is the
+// release's own rendered templates (e.g. rel.Manifest) and is used to learn
+// which ResourceDefinitions/Dependencies in namespace actually belong to
+// releaseName, by name, before stamping them with releaseName/revision --
+// without that check, any other unlabeled release sharing the namespace
+// would get relabeled too. It logs and continues past any individual update
+// failure instead of aborting the whole pass.
+func RelabelResourceDefinitions(helmClient *kube.Client, namespace, releaseName string, revision int, manifest string) error {
+	owned, err := ownedResourceNames(helmClient, namespace, manifest)
+	if err != nil {
+		return fmt.Errorf("couldn't determine resources owned by release %v: %v", releaseName, err)
+	}
+	if len(owned) == 0 {
+		return nil
+	}
+
+	c, err := client.NewForNamespace("", namespace)
+	if err != nil {
+		return fmt.Errorf("couldn't create namespaced client. Err: %v", err)
+	}
+	desired := LabelsForRelease(releaseName, revision)
+
+	resdefs, err := c.ResourceDefinitions(namespace).List(api.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("couldn't list resource definitions in namespace %v: %v", namespace, err)
+	}
+	for i := range resdefs.Items {
+		rd := &resdefs.Items[i]
+		if _, ok := rd.Labels[ReleaseLabel]; ok {
+			continue
+		}
+		if !owned[rd.Name] {
+			continue
+		}
+		rd.Labels = mergeLabels(rd.Labels, desired)
+		if _, err := c.ResourceDefinitions(namespace).Update(rd); err != nil {
+			log.Printf("WARNING: couldn't relabel resource definition %v for release %v: %v", rd.Name, releaseName, err)
+		}
+	}
+
+	deps, err := c.Dependencies(namespace).List(api.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("couldn't list dependencies in namespace %v: %v", namespace, err)
+	}
+	for i := range deps.Items {
+		dep := &deps.Items[i]
+		if _, ok := dep.Labels[ReleaseLabel]; ok {
+			continue
+		}
+		if !owned[dep.Name] {
+			continue
+		}
+		dep.Labels = mergeLabels(dep.Labels, desired)
+		if _, err := c.Dependencies(namespace).Update(dep); err != nil {
+			log.Printf("WARNING: couldn't relabel dependency %v for release %v: %v", dep.Name, releaseName, err)
+		}
+	}
+	return nil
+}
+
+// ownedResourceNames renders manifest the same way GetStatus does (via
+// kube.Client.BuildUnstructured) and returns the set of resource names it
+// declares. An empty manifest (e.g. a release parsed from the legacy
+// regex-scrape fallback, which never recovers a manifest) yields an empty
+// set rather than an error, so callers that can't determine ownership skip
+// relabeling instead of guessing.
+func ownedResourceNames(helmClient *kube.Client, namespace, manifest string) (map[string]bool, error) {
+	if strings.TrimSpace(manifest) == "" {
+		return nil, nil
+	}
+	infos, err := helmClient.BuildUnstructured(namespace, strings.NewReader(manifest))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse release manifest: %v", err)
+	}
+	owned := make(map[string]bool, len(infos))
+	for _, info := range infos {
+		owned[info.Name] = true
+	}
+	return owned, nil
+}
+
+func mergeLabels(existing, extra map[string]string) map[string]string {
+	merged := make(map[string]string, len(existing)+len(extra))
+	for k, v := range existing {
+		merged[k] = v
+	}
+	for k, v := range extra {
+		merged[k] = v
+	}
+	return merged
+}
@@ -0,0 +1,94 @@
+package appcontrollerutil
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Mirantis/k8s-AppController/pkg/client"
+	"github.com/Mirantis/k8s-appcontroller/pkg/scheduler"
+	"github.com/nebril/helm/pkg/kube"
+)
+
+// pollInterval is how often WaitForRelease re-checks the dependency graph.
+const pollInterval = 2 * time.Second
+
+// BlockedResource describes a single resource that is not finished yet:
+// Dependencies lists the dependencies still blocking it, or just
+// "creation in progress" when it is unblocked but not yet Ready.
+type BlockedResource struct {
+	Key          string
+	Dependencies []string
+}
+
+// NotReadyError is returned by WaitForRelease when timeout elapses while
+// resources are still blocked or in progress.
+type NotReadyError struct {
+	ReleaseName string
+	Blocked     []BlockedResource
+}
+
+func (e *NotReadyError) Error() string {
+	parts := make([]string, 0, len(e.Blocked))
+	for _, b := range e.Blocked {
+		parts = append(parts, fmt.Sprintf("%s (waiting for %s)", b.Key, strings.Join(b.Dependencies, ", ")))
+	}
+	return fmt.Sprintf("release %v is not ready after waiting, still blocked: %s", e.ReleaseName, strings.Join(parts, "; "))
+}
+
+// WaitForRelease blocks until every resource scheduled for releaseName is
+// unblocked and Ready, or returns a *NotReadyError listing the resources
+// still blocked or in progress and what they're waiting on once timeout
+// elapses.
+func WaitForRelease(helmClient *kube.Client, namespace, releaseName string, timeout time.Duration) error {
+	selector, err := ReleaseSelector(releaseName)
+	if err != nil {
+		return err
+	}
+	namespacedClient, err := client.NewForNamespace("", namespace)
+	if err != nil {
+		return fmt.Errorf("couldn't create namespaced client. Err: %v", err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		graph, err := scheduler.BuildDependencyGraph(namespacedClient, selector)
+		if err != nil {
+			return fmt.Errorf("couldn't create a dependency graph. Err: %v", err)
+		}
+
+		blocked := unfinishedResources(graph)
+		if len(blocked) == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return &NotReadyError{ReleaseName: releaseName, Blocked: blocked}
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// unfinishedResources returns the resources in graph that are either still
+// blocked on unsatisfied dependencies, or unblocked but not yet Ready (i.e.
+// scheduled and creation started, but not finished) -- the same distinction
+// printMissingState draws between "WAITING_FOR" and "INPROGRESS".
+func unfinishedResources(graph scheduler.DependencyGraph) []BlockedResource {
+	unfinished := []BlockedResource{}
+	for key, scheduledResource := range graph {
+		rep := scheduledResource.GetNodeReport(key)
+		if !rep.Blocked && rep.Ready {
+			continue
+		}
+		deps := []string{}
+		for _, dep := range rep.Dependencies {
+			if dep.Blocks {
+				deps = append(deps, dep.Dependency)
+			}
+		}
+		if len(deps) == 0 {
+			deps = append(deps, "creation in progress")
+		}
+		unfinished = append(unfinished, BlockedResource{Key: key, Dependencies: deps})
+	}
+	return unfinished
+}
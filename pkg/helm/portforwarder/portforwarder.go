@@ -0,0 +1,125 @@
+// Copyright 2017 Mirantis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package portforwarder opens a local port forwarded to the tiller pod so
+// that callers can talk to it with a plain helm.Client instead of shelling
+// out to the helm binary.
+package portforwarder
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/portforward"
+	"k8s.io/client-go/transport/spdy"
+)
+
+const tillerPort = 44134
+
+// Forwarder keeps a port-forward session to a tiller pod alive and exposes
+// the local address it is listening on.
+type Forwarder struct {
+	forwarder *portforward.PortForwarder
+	stopCh    chan struct{}
+	readyCh   chan struct{}
+	localPort int
+}
+
+// New finds a running tiller pod in namespace and opens a local port forward
+// to its tillerPort. Callers must call Close when done.
+func New(config *rest.Config, clientset kubernetes.Interface, namespace string) (*Forwarder, error) {
+	pod, err := findTillerPod(clientset, namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	localPort, err := freePort()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't find a free local port: %v", err)
+	}
+
+	transport, upgrader, err := spdy.RoundTripperFor(config)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create spdy round tripper: %v", err)
+	}
+
+	req := clientset.Core().RESTClient().Post().
+		Resource("pods").
+		Namespace(namespace).
+		Name(pod.Name).
+		SubResource("portforward")
+
+	dialer := spdy.NewDialer(upgrader, &http.Client{Transport: transport}, "POST", req.URL())
+
+	stopCh := make(chan struct{}, 1)
+	readyCh := make(chan struct{})
+	ports := []string{fmt.Sprintf("%d:%d", localPort, tillerPort)}
+
+	pf, err := portforward.New(dialer, ports, stopCh, readyCh, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't set up port forwarding: %v", err)
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- pf.ForwardPorts()
+	}()
+
+	select {
+	case err := <-errCh:
+		return nil, fmt.Errorf("port forwarding to tiller failed: %v", err)
+	case <-readyCh:
+	}
+
+	return &Forwarder{forwarder: pf, stopCh: stopCh, readyCh: readyCh, localPort: localPort}, nil
+}
+
+// Addr returns the local address the forwarder is listening on, suitable for
+// passing to helm.Host.
+func (f *Forwarder) Addr() string {
+	return fmt.Sprintf("127.0.0.1:%d", f.localPort)
+}
+
+// Close stops the port forward.
+func (f *Forwarder) Close() {
+	close(f.stopCh)
+}
+
+func findTillerPod(clientset kubernetes.Interface, namespace string) (*v1.Pod, error) {
+	pods, err := clientset.Core().Pods(namespace).List(v1.ListOptions{
+		LabelSelector: "app=helm,name=tiller",
+	})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't list pods in namespace %s: %v", namespace, err)
+	}
+	for _, pod := range pods.Items {
+		if pod.Status.Phase == v1.PodRunning {
+			return &pod, nil
+		}
+	}
+	return nil, fmt.Errorf("no running tiller pod found in namespace %s", namespace)
+}
+
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}